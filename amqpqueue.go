@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+)
+
+// errUnknownDelivery is returned by amqpQueue#Ack for an unrecognized or already-acked Request.
+var errUnknownDelivery = errors.New("unknown AMQP delivery")
+
+// errDeliveriesClosed is returned by amqpQueue#Fetch once the broker closed the delivery channel.
+var errDeliveriesClosed = errors.New("AMQP delivery channel closed")
+
+// amqpQueue is a RequestSource and ResponseSink backed by an AMQP 0-9-1 broker (e.g. RabbitMQ).
+type amqpQueue struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+
+	responseExchange string
+	responseKey      string
+
+	deliveries <-chan amqp.Delivery
+
+	pending   map[string]amqp.Delivery
+	pendingMu sync.Mutex
+}
+
+var _ RequestSource = (*amqpQueue)(nil)
+var _ ResponseSink = (*amqpQueue)(nil)
+
+// newAMQPQueue dials url, declares requestQueue (if missing) and returns an amqpQueue consuming it,
+// publishing responses to responseExchange (may be "" for the default exchange) with responseKey.
+// prefetch bounds how many deliveries the broker may hand out unacknowledged at once.
+func newAMQPQueue(url, requestQueue, responseExchange, responseKey string, prefetch int64) (*amqpQueue, error) {
+	conn, errDi := amqp.Dial(url)
+	if errDi != nil {
+		return nil, errDi
+	}
+
+	channel, errCh := conn.Channel()
+	if errCh != nil {
+		conn.Close()
+		return nil, errCh
+	}
+
+	if _, errQD := channel.QueueDeclare(requestQueue, true, false, false, false, nil); errQD != nil {
+		channel.Close()
+		conn.Close()
+		return nil, errQD
+	}
+
+	if errQo := channel.Qos(int(prefetch), 0, false); errQo != nil {
+		channel.Close()
+		conn.Close()
+		return nil, errQo
+	}
+
+	deliveries, errCn := channel.Consume(requestQueue, "", false, false, false, false, nil)
+	if errCn != nil {
+		channel.Close()
+		conn.Close()
+		return nil, errCn
+	}
+
+	return &amqpQueue{
+		conn:             conn,
+		channel:          channel,
+		responseExchange: responseExchange,
+		responseKey:      responseKey,
+		deliveries:       deliveries,
+		pending:          map[string]amqp.Delivery{},
+	}, nil
+}
+
+// Fetch blocks for the next delivery. A delivery whose body isn't valid JSON is logged, Nack'd and
+// dropped rather than surfaced as a Fetch error, so one poison message can't be mistaken by readLoop
+// for a backend failure and take down the whole process.
+func (q *amqpQueue) Fetch(ctx context.Context) ([]Request, error) {
+	for {
+		select {
+		case delivery, ok := <-q.deliveries:
+			if !ok {
+				return nil, errDeliveriesClosed
+			}
+
+			var values map[string]string
+			if errUj := json.Unmarshal(delivery.Body, &values); errUj != nil {
+				log.WithFields(log.Fields{"error": errUj.Error()}).Warn("dropping malformed AMQP process spawn request")
+				delivery.Nack(false, false)
+				continue
+			}
+
+			id := strconv.FormatUint(delivery.DeliveryTag, 10)
+
+			q.pendingMu.Lock()
+			q.pending[id] = delivery
+			q.pendingMu.Unlock()
+
+			return []Request{{ID: id, Values: values}}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ping reports whether the AMQP connection is still open.
+func (q *amqpQueue) Ping(context.Context) error {
+	if q.conn.IsClosed() {
+		return errors.New("AMQP connection closed")
+	}
+
+	return nil
+}
+
+func (q *amqpQueue) Ack(request Request) error {
+	q.pendingMu.Lock()
+	delivery, ok := q.pending[request.ID]
+	delete(q.pending, request.ID)
+	q.pendingMu.Unlock()
+
+	if !ok {
+		return errUnknownDelivery
+	}
+
+	return delivery.Ack(false)
+}
+
+func (q *amqpQueue) Publish(response Response) error {
+	body, errMj := json.Marshal(response.Values)
+	if errMj != nil {
+		return errMj
+	}
+
+	return q.channel.PublishWithContext(background, q.responseExchange, q.responseKey, false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
@@ -1,6 +1,10 @@
 package config
 
-import "strconv"
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
 
 // Parameter provides the constraints for a single config parameter.
 type Parameter struct {
@@ -45,6 +49,38 @@ func TypeUInt64(s string) (interface{}, error) {
 	return strconv.ParseUint(s, 10, 64)
 }
 
+// TypeInt is a Parameter#TypeParser requiring the parameter to be a signed integer.
+func TypeInt(s string) (interface{}, error) {
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// TypeBool is a Parameter#TypeParser requiring the parameter to be a boolean.
+func TypeBool(s string) (interface{}, error) {
+	return strconv.ParseBool(s)
+}
+
+// TypeFloat64 is a Parameter#TypeParser requiring the parameter to be a floating-point number.
+func TypeFloat64(s string) (interface{}, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// TypeStringList is a Parameter#TypeParser splitting a comma-separated list into its (trimmed) items.
+func TypeStringList(s string) (interface{}, error) {
+	rawItems := strings.Split(s, ",")
+	items := make([]string, 0, len(rawItems))
+
+	for _, rawItem := range rawItems {
+		item := strings.TrimSpace(rawItem)
+		if item == "" {
+			return nil, errors.New("empty list item")
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
 // NoValidator is a Parameter#Validator without any actual validator.
 func NoValidator(interface{}) error {
 	return nil
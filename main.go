@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"github.com/go-ini/ini"
-	"github.com/go-redis/redis"
+	redisotel "github.com/go-redis/redis/extra/redisotel/v8"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
 	"icinga2-procmgr/config"
+	"icinga2-procmgr/metrics"
 	"net"
 	"os"
 	"os/signal"
@@ -43,36 +48,164 @@ func main() {
 	chSignal := make(chan os.Signal, 1)
 	signal.Notify(chSignal, syscall.SIGINT, syscall.SIGTERM)
 
-	{
-		reedis := cfg["redis"]
-		opts := &redis.Options{
-			Network:      "tcp",
-			Addr:         reedis["address"].(string),
-			ReadTimeout:  time.Minute,
-			WriteTimeout: time.Minute,
-		}
+	ctx, cancel := context.WithCancel(background)
 
-		if path.IsAbs(opts.Addr) {
-			opts.Network = "unix"
-		}
+	id, errNR := uuid.NewRandom()
+	if errNR != nil {
+		log.Fatal(errNR)
+		return
+	}
 
-		if password, ok := reedis["password"].(string); ok {
-			opts.Password = password
-		}
+	maxQueueDepth := int64(cfg["manager"]["max_queue_depth"].(uint64))
 
-		if database, ok := reedis["database"].(uint64); ok {
-			opts.DB = int(database)
-		}
+	source, sink, ping, errNQ := newQueue(ctx, cfg, id.String(), maxQueueDepth)
+	if errNQ != nil {
+		log.Fatal(errNQ)
+		return
+	}
+
+	if cfg["metrics"]["enabled"].(bool) {
+		addr := cfg["metrics"]["address"].(string)
 
-		go (&manager{reedis: redis.NewClient(opts)}).readLoop()
+		go func() {
+			log.WithFields(log.Fields{"address": addr}).Info("starting metrics server")
+
+			if errSv := metrics.Serve(addr, func() error { return healthCheck(ping) }); errSv != nil {
+				log.WithFields(log.Fields{"error": errSv.Error()}).Error("metrics server stopped")
+			}
+		}()
 	}
 
+	pool := semaphore.NewWeighted(int64(cfg["manager"]["max_concurrency"].(uint64)))
+
+	sandbox := sandboxConfig{
+		defaultNice:    int(cfg["sandbox"]["default_nice"].(int64)),
+		cgroupRoot:     cfg["sandbox"]["cgroup_root"].(string),
+		allowOverrides: stringSetOf(cfg["sandbox"]["allow_overrides"].([]string)),
+	}
+
+	progressInterval := time.Duration(cfg["manager"]["progress_interval"].(float64) * float64(time.Second))
+	progressChunkSize := int64(cfg["manager"]["progress_chunk_size"].(uint64))
+
+	go (&manager{
+		id:                id,
+		source:            source,
+		sink:              sink,
+		pool:              pool,
+		sandbox:           sandbox,
+		progressInterval:  progressInterval,
+		progressChunkSize: progressChunkSize,
+	}).readLoop(ctx)
+
 	log.WithFields(log.Fields{"signal": <-chSignal}).Info("terminating due to signal")
 
 	close(shuttingDown)
+	cancel()
 	critical.Lock()
 }
 
+// healthCheck reports whether the manager is currently able to serve requests: not shutting down, and
+// its queue backend (if any) reachable per ping.
+func healthCheck(ping func(context.Context) error) error {
+	select {
+	case <-shuttingDown:
+		return errors.New("shutting down")
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(background, 5*time.Second)
+	defer cancel()
+
+	return ping(ctx)
+}
+
+// newQueue builds the RequestSource/ResponseSink selected by [queue] type, plus a ping func reporting
+// whether the backing queue is reachable. batchSize bounds how many requests may be fetched (and thus
+// left unacknowledged) at once, decoupling it from max_concurrency.
+func newQueue(ctx context.Context, cfg map[string]map[string]interface{}, consumer string, batchSize int64) (RequestSource, ResponseSink, func(context.Context) error, error) {
+	switch cfg["queue"]["type"].(string) {
+	case "memory":
+		q := newMemQueue()
+		return q, q, func(context.Context) error { return nil }, nil
+	case "amqp":
+		amqpCfg := cfg["queue"]
+
+		q, errNA := newAMQPQueue(
+			amqpCfg["amqp_url"].(string),
+			amqpCfg["amqp_request_queue"].(string),
+			amqpCfg["amqp_response_exchange"].(string),
+			amqpCfg["amqp_response_routing_key"].(string),
+			batchSize,
+		)
+		if errNA != nil {
+			return nil, nil, nil, errNA
+		}
+
+		return q, q, q.Ping, nil
+	default:
+		reedis := cfg["redis"]
+
+		var password string
+		if p, ok := reedis["password"].(string); ok {
+			password = p
+		}
+
+		var database int
+		if d, ok := reedis["database"].(uint64); ok {
+			database = int(d)
+		}
+
+		var client redis.UniversalClient
+
+		switch reedis["mode"].(string) {
+		case "sentinel":
+			client = redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:    reedis["master_name"].(string),
+				SentinelAddrs: reedis["sentinels"].([]string),
+				Password:      password,
+				DB:            database,
+				ReadTimeout:   time.Minute,
+				WriteTimeout:  time.Minute,
+			})
+		case "cluster":
+			client = redis.NewClusterClient(&redis.ClusterOptions{
+				Addrs:        reedis["addresses"].([]string),
+				Password:     password,
+				ReadTimeout:  time.Minute,
+				WriteTimeout: time.Minute,
+			})
+		default:
+			opts := &redis.Options{
+				Network:      "tcp",
+				Addr:         reedis["address"].(string),
+				Password:     password,
+				DB:           database,
+				ReadTimeout:  time.Minute,
+				WriteTimeout: time.Minute,
+			}
+
+			if path.IsAbs(opts.Addr) {
+				opts.Network = "unix"
+			}
+
+			client = redis.NewClient(opts)
+		}
+
+		client.AddHook(commandLogHook{})
+
+		if trace, ok := reedis["trace"].(bool); ok && trace {
+			client.AddHook(redisotel.NewTracingHook())
+		}
+
+		q, errNR := newRedisQueue(ctx, client, consumer, batchSize, reedis["progress_stream"].(string))
+		if errNR != nil {
+			return nil, nil, nil, errNR
+		}
+
+		return q, q, q.Ping, nil
+	}
+}
+
 // loadConfig reads, parses and validates the config from the given path.
 func loadConfig(path string) (map[string]map[string]interface{}, error) {
 	cfg, errCfg := ini.Load(path)
@@ -137,25 +270,166 @@ func loadConfig(path string) (map[string]map[string]interface{}, error) {
 				Validator:    config.OneOf([]string{"text", "json"}),
 			},
 		},
-		"redis": {
+		"manager": {
+			"max_concurrency": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      uint64(10),
+				TypeParser:   config.TypeUInt64,
+				Validator:    config.NoValidator,
+			},
+			"max_queue_depth": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      uint64(100),
+				TypeParser:   config.TypeUInt64,
+				Validator:    config.NoValidator,
+			},
+			"progress_interval": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      5.0,
+				TypeParser:   config.TypeFloat64,
+				Validator:    config.NoValidator,
+			},
+			"progress_chunk_size": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      uint64(4096),
+				TypeParser:   config.TypeUInt64,
+				Validator:    config.NoValidator,
+			},
+		},
+		"sandbox": {
+			"default_nice": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      int64(0),
+				TypeParser:   config.TypeInt,
+				Validator:    config.NoValidator,
+			},
+			"allow_overrides": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      []string{},
+				TypeParser:   config.TypeStringList,
+				Validator:    config.NoValidator,
+			},
+			"cgroup_root": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      "",
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+		},
+		"metrics": {
+			"enabled": {
+				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      false,
+				TypeParser:   config.TypeBool,
+				Validator:    config.NoValidator,
+			},
 			"address": {
+				PreCondition: metricsEnabled,
+				Required:     config.Required,
+				TypeParser:   config.TypeString,
+				Validator:    validateListenAddress,
+			},
+		},
+		"queue": {
+			"type": {
 				PreCondition: config.NoPreCondition,
+				Required:     config.Optional,
+				Default:      "redis",
+				TypeParser:   config.TypeString,
+				Validator:    config.OneOf([]string{"redis", "memory", "amqp"}),
+			},
+			"amqp_url": {
+				PreCondition: queueTypeIs("amqp"),
+				Required:     config.Required,
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+			"amqp_request_queue": {
+				PreCondition: queueTypeIs("amqp"),
+				Required:     config.Required,
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+			"amqp_response_exchange": {
+				PreCondition: queueTypeIs("amqp"),
+				Required:     config.Optional,
+				Default:      "",
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+			"amqp_response_routing_key": {
+				PreCondition: queueTypeIs("amqp"),
+				Required:     config.Required,
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+		},
+		"redis": {
+			"mode": {
+				PreCondition: queueTypeIs("redis"),
+				Required:     config.Optional,
+				Default:      "single",
+				TypeParser:   config.TypeString,
+				Validator:    config.OneOf([]string{"single", "sentinel", "cluster"}),
+			},
+			"address": {
+				PreCondition: allOf(queueTypeIs("redis"), redisModeIs("single")),
 				Required:     config.Required,
 				TypeParser:   config.TypeString,
 				Validator:    validateRedisAddress,
 			},
+			"master_name": {
+				PreCondition: allOf(queueTypeIs("redis"), redisModeIs("sentinel")),
+				Required:     config.Required,
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
+			"sentinels": {
+				PreCondition: allOf(queueTypeIs("redis"), redisModeIs("sentinel")),
+				Required:     config.Required,
+				TypeParser:   config.TypeStringList,
+				Validator:    validateRedisAddressList,
+			},
+			"addresses": {
+				PreCondition: allOf(queueTypeIs("redis"), redisModeIs("cluster")),
+				Required:     config.Required,
+				TypeParser:   config.TypeStringList,
+				Validator:    validateRedisAddressList,
+			},
 			"password": {
-				PreCondition: config.NoPreCondition,
+				PreCondition: queueTypeIs("redis"),
 				Required:     config.Optional,
 				TypeParser:   config.TypeString,
 				Validator:    config.NoValidator,
 			},
 			"database": {
-				PreCondition: config.NoPreCondition,
+				PreCondition: queueTypeIs("redis"),
 				Required:     config.Optional,
 				TypeParser:   config.TypeUInt64,
 				Validator:    config.NoValidator,
 			},
+			"trace": {
+				PreCondition: queueTypeIs("redis"),
+				Required:     config.Optional,
+				Default:      false,
+				TypeParser:   config.TypeBool,
+				Validator:    config.NoValidator,
+			},
+			"progress_stream": {
+				PreCondition: queueTypeIs("redis"),
+				Required:     config.Optional,
+				Default:      "icinga2:process:progress",
+				TypeParser:   config.TypeString,
+				Validator:    config.NoValidator,
+			},
 		},
 	}).Validate(rawCfg)
 }
@@ -195,3 +469,60 @@ func validateRedisAddress(addr interface{}) error {
 	_, errLP := net.LookupPort("tcp", port)
 	return errLP
 }
+
+// validateRedisAddressList validates a list of Redis server addresses.
+func validateRedisAddressList(addrs interface{}) error {
+	for _, addr := range addrs.([]string) {
+		if errVA := validateRedisAddress(addr); errVA != nil {
+			return errVA
+		}
+	}
+
+	return nil
+}
+
+// validateListenAddress validates an HTTP server's "host:port" listen address.
+func validateListenAddress(addr interface{}) error {
+	_, port, errSA := net.SplitHostPort(addr.(string))
+	if errSA != nil {
+		return errSA
+	}
+
+	_, errLP := net.LookupPort("tcp", port)
+	return errLP
+}
+
+// metricsEnabled is a Parameter#PreCondition requiring [metrics]'s enabled to be true.
+func metricsEnabled(states map[string]map[string]*config.ParameterValidationState) bool {
+	enabled := states["metrics"]["enabled"].Value
+	return enabled != nil && enabled.(bool)
+}
+
+// redisModeIs is a Parameter#PreCondition factory requiring [redis]'s mode to be the given one.
+func redisModeIs(mode string) func(map[string]map[string]*config.ParameterValidationState) bool {
+	return func(states map[string]map[string]*config.ParameterValidationState) bool {
+		actual := states["redis"]["mode"].Value
+		return actual != nil && actual.(string) == mode
+	}
+}
+
+// queueTypeIs is a Parameter#PreCondition factory requiring [queue]'s type to be the given one.
+func queueTypeIs(queueType string) func(map[string]map[string]*config.ParameterValidationState) bool {
+	return func(states map[string]map[string]*config.ParameterValidationState) bool {
+		actual := states["queue"]["type"].Value
+		return actual != nil && actual.(string) == queueType
+	}
+}
+
+// allOf is a Parameter#PreCondition factory requiring all of the given preconditions to hold.
+func allOf(preConditions ...func(map[string]map[string]*config.ParameterValidationState) bool) func(map[string]map[string]*config.ParameterValidationState) bool {
+	return func(states map[string]map[string]*config.ParameterValidationState) bool {
+		for _, preCondition := range preConditions {
+			if !preCondition(states) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
@@ -2,130 +2,129 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+	"icinga2-procmgr/metrics"
 	"os"
 	"os/exec"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 type manager struct {
-	id     uuid.UUID
-	reedis *redis.Client
-	ourEnv struct {
+	id      uuid.UUID
+	source  RequestSource
+	sink    ResponseSink
+	pool    *semaphore.Weighted
+	sandbox sandboxConfig
+	ourEnv  struct {
 		vars []string
 		once sync.Once
 	}
-}
-
-func (m *manager) readLoop() {
-	{
-		var errNR error
-		m.id, errNR = uuid.NewRandom()
-
-		if errNR != nil {
-			log.WithFields(log.Fields{"error": errNR.Error()}).Fatal("couldn't generate new UUID")
-			return
-		}
-	}
 
-	{
-		_, errGC := m.reedis.XGroupCreateMkStream("icinga2:process:spawn", "icinga2-procmgr", "0-0").Result()
-		if errGC != nil && !strings.HasPrefix(errGC.Error(), "BUSYGROUP ") {
-			log.WithFields(log.Fields{
-				"stream": "icinga2:process:spawn",
-				"group":  "icinga2-procmgr",
-				"error":  errGC.Error(),
-			}).Fatal("couldn't create Redis stream consumer group")
-			return
-		}
-	}
+	// progressInterval and progressChunkSize govern how often, and how much output at once,
+	// handleRequest reports a still-running process's progress. Only used if sink is a ProgressSink.
+	progressInterval  time.Duration
+	progressChunkSize int64
+}
 
+// readLoop runs until ctx is canceled, which also unblocks any in-flight Fetch call. Dispatching a
+// fetched request blocks until pool has a free slot, so a saturated pool back-pressures Fetch itself,
+// leaving surplus requests unacknowledged at their source.
+func (m *manager) readLoop(ctx context.Context) {
 	log.WithFields(log.Fields{"me": m.id}).Info("handling process spawn requests")
 
 	for {
-		streams, errRG := m.reedis.XReadGroup(&redis.XReadGroupArgs{
-			Group:    "icinga2-procmgr",
-			Consumer: m.id.String(),
-			Streams:  []string{"icinga2:process:spawn", ">"},
-			Count:    100,
-		}).Result()
-
-		if errRG != nil {
-			log.WithFields(log.Fields{
-				"stream": "icinga2:process:spawn",
-				"group":  "icinga2-procmgr",
-				"error":  errRG.Error(),
-			}).Fatal("couldn't read from Redis stream")
+		requests, errFt := m.source.Fetch(ctx)
+		if errFt != nil {
+			if ctx.Err() != nil {
+				log.WithFields(log.Fields{"me": m.id}).Info("stopping process spawn request handling")
+				return
+			}
+
+			log.WithFields(log.Fields{"error": errFt.Error()}).Fatal("couldn't fetch process spawn requests")
 			return
 		}
 
-		for _, stream := range streams {
-			for _, message := range stream.Messages {
-				go m.handleRequest(message)
+		metrics.RequestsReceived.Add(float64(len(requests)))
+
+		for _, request := range requests {
+			if errAc := m.pool.Acquire(ctx, 1); errAc != nil {
+				log.WithFields(log.Fields{"me": m.id}).Info("stopping process spawn request handling")
+				return
 			}
+
+			go m.handleRequest(request)
 		}
 	}
 }
 
-func (m *manager) handleRequest(message redis.XMessage) {
-	rawId, ok := message.Values["id"].(string)
+func (m *manager) handleRequest(request Request) {
+	defer m.pool.Release(1)
+
+	rawId, ok := request.Values["id"]
 	if !ok {
 		log.WithFields(log.Fields{
-			"redis_id": message.ID,
+			"queue_id": request.ID,
 		}).Warn("throwing away process spawn request w/o actual request ID")
 
-		m.ackMsg(m.reedis, message)
+		metrics.SpawnFailures.WithLabelValues("bad_request").Inc()
+		m.ackRequest(request)
 		return
 	}
 
 	log.WithFields(log.Fields{"request": rawId}).Trace("got process spawn request")
 
-	rawCommand, ok := message.Values["command"].(string)
+	rawCommand, ok := request.Values["command"]
 	if !ok {
-		m.sendFailure(message, rawId, "bad command spec")
+		m.sendFailure(request, rawId, "bad_request", "bad command spec")
 		return
 	}
 
 	var command []string
 	if errJU := json.Unmarshal([]byte(rawCommand), &command); errJU != nil {
-		m.sendFailure(message, rawId, "bad command spec: "+errJU.Error())
+		m.sendFailure(request, rawId, "bad_request", "bad command spec: "+errJU.Error())
 		return
 	}
 
 	if len(command) < 1 {
-		m.sendFailure(message, rawId, "bad command spec")
+		m.sendFailure(request, rawId, "bad_request", "bad command spec")
 		return
 	}
 
-	rawEnv, ok := message.Values["env"].(string)
+	rawEnv, ok := request.Values["env"]
 	if !ok {
-		m.sendFailure(message, rawId, "bad env spec")
+		m.sendFailure(request, rawId, "bad_request", "bad env spec")
 		return
 	}
 
 	var env []string
 	if errJU := json.Unmarshal([]byte(rawEnv), &env); errJU != nil {
-		m.sendFailure(message, rawId, "bad env spec: "+errJU.Error())
+		m.sendFailure(request, rawId, "bad_request", "bad env spec: "+errJU.Error())
 		return
 	}
 
-	rawTimeout, ok := message.Values["timeout"].(string)
+	rawTimeout, ok := request.Values["timeout"]
 	if !ok {
-		m.sendFailure(message, rawId, "bad timeout spec")
+		m.sendFailure(request, rawId, "bad_request", "bad timeout spec")
 		return
 	}
 
 	timeout, errPF := strconv.ParseFloat(rawTimeout, 64)
 	if errPF != nil {
-		m.sendFailure(message, rawId, "bad timeout spec: "+errPF.Error())
+		m.sendFailure(request, rawId, "bad_request", "bad timeout spec: "+errPF.Error())
+		return
+	}
+
+	sandbox, errPs := parseSandboxSpec(request.Values)
+	if errPs != nil {
+		m.sendFailure(request, rawId, "bad_request", errPs.Error())
 		return
 	}
 
@@ -138,7 +137,7 @@ func (m *manager) handleRequest(message redis.XMessage) {
 	cmd.Env = append(m.ourEnv.vars, env...)
 	cmd.Stdout = &sharedOut
 	cmd.Stderr = &sharedOut
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Pdeathsig: syscall.SIGKILL}
 
 	critical.RLock()
 	defer critical.RUnlock()
@@ -148,6 +147,18 @@ func (m *manager) handleRequest(message redis.XMessage) {
 	if errSt := cmd.Start(); errSt == nil {
 		start := time.Now()
 
+		metrics.RunningProcesses.Inc()
+		defer metrics.RunningProcesses.Dec()
+
+		if errSb := applySandbox(cmd.Process.Pid, command[0], sandbox, m.sandbox); errSb != nil {
+			log.WithFields(log.Fields{"request": rawId, "error": errSb.Error()}).Warn("couldn't apply sandbox limits")
+
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			m.sendFailure(request, rawId, "sandbox", "couldn't apply sandbox limits: "+errSb.Error())
+			return
+		}
+
 		timer := time.NewTimer(time.Duration(timeout * float64(time.Second)))
 		defer timer.Stop()
 
@@ -158,6 +169,16 @@ func (m *manager) handleRequest(message redis.XMessage) {
 		var end time.Time
 		timerCh := timer.C
 
+		progressSink, hasProgress := m.sink.(ProgressSink)
+		var progressTickerCh <-chan time.Time
+		var offset int
+
+		if hasProgress && m.progressInterval > 0 {
+			progressTicker := time.NewTicker(m.progressInterval)
+			defer progressTicker.Stop()
+			progressTickerCh = progressTicker.C
+		}
+
 	Wait:
 		for {
 			select {
@@ -167,10 +188,13 @@ func (m *manager) handleRequest(message redis.XMessage) {
 			case <-timerCh:
 				log.WithFields(log.Fields{"request": rawId}).Warn("timeout exceeded")
 
+				metrics.TimeoutKills.Inc()
 				sharedOut.Write([]byte("<Timeout exceeded.>"))
 				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 				timerCh = nil
 				break
+			case <-progressTickerCh:
+				m.sendProgress(progressSink, &sharedOut, &out, rawId, cmd.Process.Pid, &offset, start)
 			case <-shuttingDown:
 				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 				<-waitErr
@@ -179,57 +203,62 @@ func (m *manager) handleRequest(message redis.XMessage) {
 		}
 
 		log.WithFields(log.Fields{"request": rawId}).Debug("process finished")
+		metrics.Duration.Observe(end.Sub(start).Seconds())
 
 		if errWt == nil {
-			m.sendResponse(message, rawId, cmd.Process.Pid, 0, out.Bytes(), start, end)
+			metrics.ExitCodes.WithLabelValues("exited").Inc()
+			m.sendResponse(request, rawId, cmd.Process.Pid, 0, out.Bytes(), start, end)
 		} else if ee, ok := errWt.(*exec.ExitError); ok {
 			var exitCode int
 			status := ee.ProcessState.Sys().(syscall.WaitStatus)
 
 			if status.Exited() {
 				exitCode = status.ExitStatus()
+				metrics.ExitCodes.WithLabelValues("exited").Inc()
 			} else if status.Signaled() {
 				exitCode = 128 + int(status.Signal())
 				fmt.Fprintf(&sharedOut, "<Terminated by signal %s.>", status.Signal())
+				metrics.ExitCodes.WithLabelValues("signaled").Inc()
 			} else if status.Stopped() {
 				exitCode = 128 + int(status.StopSignal())
 				fmt.Fprintf(&sharedOut, "<Terminated by signal %s.>", status.StopSignal())
+				metrics.ExitCodes.WithLabelValues("stopped").Inc()
 			} else if status.Continued() {
 				exitCode = 128 + int(syscall.SIGCONT)
 				fmt.Fprintf(&sharedOut, "<Terminated by signal %s.>", syscall.SIGCONT)
+				metrics.ExitCodes.WithLabelValues("continued").Inc()
 			} else {
 				exitCode = 128
 				fmt.Fprintf(&sharedOut, "<%s>", ee.Error())
+				metrics.ExitCodes.WithLabelValues("unknown").Inc()
 			}
 
-			m.sendResponse(message, rawId, cmd.Process.Pid, exitCode, out.Bytes(), start, end)
+			m.sendResponse(request, rawId, cmd.Process.Pid, exitCode, out.Bytes(), start, end)
 		} else {
 			fmt.Fprintf(&sharedOut, "<%s>", errWt.Error())
-			m.sendResponse(message, rawId, -1, 128, out.Bytes(), start, end)
+			metrics.ExitCodes.WithLabelValues("error").Inc()
+			m.sendResponse(request, rawId, -1, 128, out.Bytes(), start, end)
 		}
 	} else {
-		m.sendFailure(message, rawId, errSt.Error())
+		m.sendFailure(request, rawId, "exec", errSt.Error())
 	}
 }
 
-func (m *manager) sendFailure(message redis.XMessage, rawId string, reason string) {
+func (m *manager) sendFailure(request Request, rawId string, class string, reason string) {
 	now := time.Now()
 
 	log.WithFields(log.Fields{"request": rawId, "reason": reason}).Warn("couldn't handle process spawn request")
+	metrics.SpawnFailures.WithLabelValues(class).Inc()
 
 	m.sendResponse(
-		message, rawId, -1, 128,
+		request, rawId, -1, 128,
 		[]byte(fmt.Sprintf("[Icinga 2 process manager %s] %s", m.id.String(), reason)),
 		now, now,
 	)
 }
 
-func (m *manager) sendResponse(message redis.XMessage, rawId string, pid, exitCode int, output []byte, execStart, execEnd time.Time) {
-	tx := m.reedis.TxPipeline()
-
-	tx.XAdd(&redis.XAddArgs{
-		Stream: "icinga2:process:exit",
-		ID:     "*",
+func (m *manager) sendResponse(request Request, rawId string, pid, exitCode int, output []byte, execStart, execEnd time.Time) {
+	response := Response{
 		Values: map[string]interface{}{
 			"id":         rawId,
 			"pid":        strconv.FormatInt(int64(pid), 10),
@@ -238,24 +267,54 @@ func (m *manager) sendResponse(message redis.XMessage, rawId string, pid, exitCo
 			"exec_start": strconv.FormatFloat(time2Float(execStart), 'f', -1, 64),
 			"exec_end":   strconv.FormatFloat(time2Float(execEnd), 'f', -1, 64),
 		},
-	})
-
-	m.ackMsg(tx, message)
+	}
 
-	if _, errEx := tx.Exec(); errEx == nil {
+	if errPb := m.sink.Publish(response); errPb == nil {
 		log.WithFields(log.Fields{"request": rawId}).Trace("responded to process spawn request")
 	} else {
 		log.WithFields(log.Fields{
-			"request": rawId, "error": errEx.Error(),
+			"request": rawId, "error": errPb.Error(),
 		}).Error("couldn't respond to process spawn request")
 	}
+
+	m.ackRequest(request)
+}
+
+// sendProgress reports up to m.progressChunkSize bytes of out appended since *offset, as a liveness
+// update for the still-running pid. It advances *offset by however much it actually reported.
+func (m *manager) sendProgress(sink ProgressSink, sharedOut *sharedWriter, out *bytes.Buffer, rawId string, pid int, offset *int, execStart time.Time) {
+	sharedOut.Lock()
+	end := out.Len()
+	if int64(end-*offset) > m.progressChunkSize {
+		end = *offset + int(m.progressChunkSize)
+	}
+	chunk := append([]byte(nil), out.Bytes()[*offset:end]...)
+	sharedOut.Unlock()
+
+	progress := Progress{
+		Values: map[string]interface{}{
+			"id":                    rawId,
+			"pid":                   strconv.FormatInt(int64(pid), 10),
+			"partial_output_offset": strconv.Itoa(*offset),
+			"output_chunk":          string(chunk),
+			"elapsed":               strconv.FormatFloat(time.Since(execStart).Seconds(), 'f', -1, 64),
+		},
+	}
+
+	if errPp := sink.PublishProgress(progress); errPp == nil {
+		*offset = end
+	} else {
+		log.WithFields(log.Fields{
+			"request": rawId, "error": errPp.Error(),
+		}).Warn("couldn't report process spawn request progress")
+	}
 }
 
-func (m *manager) ackMsg(client redis.Cmdable, message redis.XMessage) {
-	if _, errXA := client.XAck("icinga2:process:spawn", "icinga2-procmgr", message.ID).Result(); errXA != nil {
+func (m *manager) ackRequest(request Request) {
+	if errAk := m.source.Ack(request); errAk != nil {
 		log.WithFields(log.Fields{
-			"redis_id": message.ID, "error": errXA.Error(),
-		}).Error("couldn't XACK process spawn request")
+			"queue_id": request.ID, "error": errAk.Error(),
+		}).Error("couldn't acknowledge process spawn request")
 	}
 }
 
@@ -0,0 +1,46 @@
+package main
+
+import "context"
+
+// memQueueCapacity bounds how many requests/responses a memQueue buffers.
+const memQueueCapacity = 1000
+
+// memQueue is an in-memory RequestSource and ResponseSink, chiefly useful for tests.
+type memQueue struct {
+	requests  chan Request
+	responses chan Response
+}
+
+var _ RequestSource = (*memQueue)(nil)
+var _ ResponseSink = (*memQueue)(nil)
+
+// newMemQueue returns an empty memQueue.
+func newMemQueue() *memQueue {
+	return &memQueue{
+		requests:  make(chan Request, memQueueCapacity),
+		responses: make(chan Response, memQueueCapacity),
+	}
+}
+
+// Enqueue makes request available to the next Fetch call.
+func (q *memQueue) Enqueue(request Request) {
+	q.requests <- request
+}
+
+func (q *memQueue) Fetch(ctx context.Context) ([]Request, error) {
+	select {
+	case request := <-q.requests:
+		return []Request{request}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *memQueue) Ack(Request) error {
+	return nil
+}
+
+func (q *memQueue) Publish(response Response) error {
+	q.responses <- response
+	return nil
+}
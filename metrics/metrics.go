@@ -0,0 +1,69 @@
+// Package metrics exposes the process manager's Prometheus metrics and health endpoint.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// RequestsReceived counts process spawn requests fetched from the queue.
+	RequestsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icinga2_procmgr_requests_received_total",
+		Help: "Process spawn requests fetched from the queue.",
+	})
+
+	// SpawnFailures counts requests that failed before or while starting the process, by reason.
+	SpawnFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icinga2_procmgr_spawn_failures_total",
+		Help: "Process spawn requests that failed before or while starting the process, by reason.",
+	}, []string{"reason"})
+
+	// ExitCodes counts finished processes, by exit status class.
+	ExitCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icinga2_procmgr_exit_codes_total",
+		Help: "Finished processes, by exit status class (exited, signaled, stopped, continued, unknown, error).",
+	}, []string{"class"})
+
+	// Duration observes the wall-clock duration of spawned processes, from start to exit.
+	Duration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "icinga2_procmgr_duration_seconds",
+		Help:    "Wall-clock duration of spawned processes, from start to exit.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// TimeoutKills counts processes killed for exceeding their request's timeout.
+	TimeoutKills = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icinga2_procmgr_timeout_kills_total",
+		Help: "Processes killed for exceeding their request's timeout.",
+	})
+
+	// RunningProcesses gauges child processes currently running.
+	RunningProcesses = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "icinga2_procmgr_running_processes",
+		Help: "Child processes currently running.",
+	})
+
+	// RedisFetchLatency observes the latency of Redis XREADGROUP calls fetching spawn requests.
+	RedisFetchLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "icinga2_procmgr_redis_fetch_latency_seconds",
+		Help:    "Latency of Redis XREADGROUP calls fetching spawn requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// RedisPendingEntries gauges the Redis consumer group's pending entries list length (XPENDING).
+	RedisPendingEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "icinga2_procmgr_redis_pending_entries",
+		Help: "Length of the Redis consumer group's pending entries list (XPENDING).",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RequestsReceived,
+		SpawnFailures,
+		ExitCodes,
+		Duration,
+		TimeoutKills,
+		RunningProcesses,
+		RedisFetchLatency,
+		RedisPendingEntries,
+	)
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Serve starts the metrics and health HTTP server on addr, blocking until it fails. It exposes
+// Prometheus metrics on /metrics and healthy on /healthz, returning non-200 once healthy errors.
+func Serve(addr string, healthy func() error) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := healthy(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "context"
+
+// Request is a single process spawn request fetched from a RequestSource.
+type Request struct {
+	// ID identifies the request within its RequestSource, e.g. for Ack.
+	ID string
+
+	// Values holds the request's fields, e.g. "command", "env" and "timeout".
+	Values map[string]string
+}
+
+// Response is a finished process's result, handed to a ResponseSink.
+type Response struct {
+	// Values holds the response's fields, e.g. "id", "pid" and "output".
+	Values map[string]interface{}
+}
+
+// RequestSource delivers process spawn requests from some backing queue.
+type RequestSource interface {
+	// Fetch blocks until either new requests are available or ctx is done.
+	Fetch(ctx context.Context) ([]Request, error)
+
+	// Ack marks request as processed so it won't be redelivered.
+	Ack(request Request) error
+}
+
+// ResponseSink publishes a process's result to some backing queue.
+type ResponseSink interface {
+	// Publish hands off response, e.g. onto icinga2:process:exit.
+	Publish(response Response) error
+}
+
+// Progress is a liveness/partial-output update for a still-running process.
+type Progress struct {
+	// Values holds the update's fields, e.g. "id", "pid" and "output_chunk".
+	Values map[string]interface{}
+}
+
+// ProgressSink optionally accepts Progress updates for long-running processes. A ResponseSink may
+// implement it, e.g. onto icinga2:process:progress; backends that don't are used without progress.
+type ProgressSink interface {
+	PublishProgress(progress Progress) error
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// commandLogHook is a redis.Hook logging every command issued against the client it's added to via logrus.
+type commandLogHook struct{}
+
+var _ redis.Hook = commandLogHook{}
+
+// cmdStartedAt is the context.Context key commandLogHook uses to measure a command's duration.
+type cmdStartedAt struct{}
+
+func (commandLogHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, cmdStartedAt{}, time.Now()), nil
+}
+
+func (commandLogHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	logRedisCmd(ctx, cmd)
+	return nil
+}
+
+func (commandLogHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, cmdStartedAt{}, time.Now()), nil
+}
+
+func (commandLogHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		logRedisCmd(ctx, cmd)
+	}
+
+	return nil
+}
+
+// logRedisCmd emits one structured log entry for a finished Redis command.
+func logRedisCmd(ctx context.Context, cmd redis.Cmder) {
+	fields := log.Fields{"command": cmd.Name()}
+
+	if startedAt, ok := ctx.Value(cmdStartedAt{}).(time.Time); ok {
+		fields["duration"] = time.Since(startedAt).String()
+	}
+
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Error("Redis command failed")
+	} else {
+		log.WithFields(fields).Trace("Redis command finished")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"icinga2-procmgr/metrics"
+	"strings"
+	"time"
+)
+
+const redisSpawnStream = "icinga2:process:spawn"
+const redisExitStream = "icinga2:process:exit"
+const redisConsumerGroup = "icinga2-procmgr"
+
+// redisPendingPollInterval is how often a redisQueue samples its pending entries list length.
+const redisPendingPollInterval = 30 * time.Second
+
+// redisQueue is a RequestSource, ResponseSink and ProgressSink backed by Redis Streams.
+type redisQueue struct {
+	client         redis.UniversalClient
+	consumer       string
+	batchSize      int64
+	progressStream string
+}
+
+var _ RequestSource = (*redisQueue)(nil)
+var _ ResponseSink = (*redisQueue)(nil)
+var _ ProgressSink = (*redisQueue)(nil)
+
+// newRedisQueue creates the icinga2:process:spawn consumer group (if missing) and returns a redisQueue
+// reading from it as consumer, fetching at most batchSize undelivered messages per Fetch call and
+// publishing progress updates onto progressStream.
+func newRedisQueue(ctx context.Context, client redis.UniversalClient, consumer string, batchSize int64, progressStream string) (*redisQueue, error) {
+	_, errGC := client.XGroupCreateMkStream(ctx, redisSpawnStream, redisConsumerGroup, "0-0").Result()
+	if errGC != nil && !strings.HasPrefix(errGC.Error(), "BUSYGROUP ") {
+		return nil, errGC
+	}
+
+	q := &redisQueue{client: client, consumer: consumer, batchSize: batchSize, progressStream: progressStream}
+	go q.pollPendingEntries(ctx)
+
+	return q, nil
+}
+
+// pollPendingEntries periodically samples the consumer group's pending entries list length into
+// metrics.RedisPendingEntries, until ctx is done.
+func (q *redisQueue) pollPendingEntries(ctx context.Context) {
+	ticker := time.NewTicker(redisPendingPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pending, errXP := q.client.XPending(ctx, redisSpawnStream, redisConsumerGroup).Result()
+			if errXP != nil {
+				log.WithFields(log.Fields{"error": errXP.Error()}).Warn("couldn't query pending entries list length")
+				continue
+			}
+
+			metrics.RedisPendingEntries.Set(float64(pending.Count))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *redisQueue) Fetch(ctx context.Context) ([]Request, error) {
+	fetchStart := time.Now()
+	streams, errRG := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    redisConsumerGroup,
+		Consumer: q.consumer,
+		Streams:  []string{redisSpawnStream, ">"},
+		Count:    q.batchSize,
+	}).Result()
+	metrics.RedisFetchLatency.Observe(time.Since(fetchStart).Seconds())
+
+	if errRG != nil {
+		return nil, errRG
+	}
+
+	var requests []Request
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			values := make(map[string]string, len(message.Values))
+
+			for field, value := range message.Values {
+				if s, ok := value.(string); ok {
+					values[field] = s
+				}
+			}
+
+			requests = append(requests, Request{ID: message.ID, Values: values})
+		}
+	}
+
+	return requests, nil
+}
+
+// Ping reports whether the Redis server is reachable.
+func (q *redisQueue) Ping(ctx context.Context) error {
+	return q.client.Ping(ctx).Err()
+}
+
+func (q *redisQueue) Ack(request Request) error {
+	_, err := q.client.XAck(background, redisSpawnStream, redisConsumerGroup, request.ID).Result()
+	return err
+}
+
+func (q *redisQueue) Publish(response Response) error {
+	_, err := q.client.XAdd(background, &redis.XAddArgs{
+		Stream: redisExitStream,
+		ID:     "*",
+		Values: response.Values,
+	}).Result()
+
+	return err
+}
+
+func (q *redisQueue) PublishProgress(progress Progress) error {
+	_, err := q.client.XAdd(background, &redis.XAddArgs{
+		Stream: q.progressStream,
+		ID:     "*",
+		Values: progress.Values,
+	}).Result()
+
+	return err
+}
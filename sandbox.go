@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ioprioWhoProcess is Linux's IOPRIO_WHO_PROCESS, the ioprio_set "who" identifying a single PID.
+const ioprioWhoProcess = 1
+
+// rlimitResources maps a spawn request's rlimit names onto their RLIMIT_* constant.
+var rlimitResources = map[string]int{
+	"cpu":     unix.RLIMIT_CPU,
+	"fsize":   unix.RLIMIT_FSIZE,
+	"data":    unix.RLIMIT_DATA,
+	"stack":   unix.RLIMIT_STACK,
+	"core":    unix.RLIMIT_CORE,
+	"rss":     unix.RLIMIT_RSS,
+	"nproc":   unix.RLIMIT_NPROC,
+	"nofile":  unix.RLIMIT_NOFILE,
+	"memlock": unix.RLIMIT_MEMLOCK,
+	"as":      unix.RLIMIT_AS,
+}
+
+// rlimitSpec is one entry of a spawn request's "rlimits" field.
+type rlimitSpec struct {
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// ioniceSpec is a spawn request's "ionice" field, "class:priority".
+type ioniceSpec struct {
+	Class    int
+	Priority int
+}
+
+// sandboxSpec is a spawn request's optional resource-limiting fields.
+type sandboxSpec struct {
+	Rlimits map[string]rlimitSpec
+	Cgroup  string
+	Nice    *int
+	Ionice  *ioniceSpec
+}
+
+// sandboxConfig is [sandbox]'s configuration: the nice value applied to every spawned process by
+// default, the directory a request's cgroup must resolve under, and the set of commands allowed to
+// override defaultNice and use the other sandboxSpec fields.
+type sandboxConfig struct {
+	defaultNice    int
+	cgroupRoot     string
+	allowOverrides map[string]bool
+}
+
+// parseSandboxSpec decodes a spawn request's optional rlimits, cgroup, nice and ionice fields.
+func parseSandboxSpec(values map[string]string) (sandboxSpec, error) {
+	var spec sandboxSpec
+
+	if raw, ok := values["rlimits"]; ok {
+		if errJU := json.Unmarshal([]byte(raw), &spec.Rlimits); errJU != nil {
+			return sandboxSpec{}, errors.New("bad rlimits spec: " + errJU.Error())
+		}
+
+		for name := range spec.Rlimits {
+			if _, ok := rlimitResources[name]; !ok {
+				return sandboxSpec{}, errors.New("unknown rlimit: " + name)
+			}
+		}
+	}
+
+	spec.Cgroup = values["cgroup"]
+
+	if raw, ok := values["nice"]; ok {
+		nice, errPi := strconv.Atoi(raw)
+		if errPi != nil {
+			return sandboxSpec{}, errors.New("bad nice spec: " + errPi.Error())
+		}
+
+		spec.Nice = &nice
+	}
+
+	if raw, ok := values["ionice"]; ok {
+		class, priority, errPi := parseIonice(raw)
+		if errPi != nil {
+			return sandboxSpec{}, errPi
+		}
+
+		spec.Ionice = &ioniceSpec{Class: class, Priority: priority}
+	}
+
+	return spec, nil
+}
+
+// parseIonice parses a spawn request's "class:priority" ionice field.
+func parseIonice(raw string) (class, priority int, err error) {
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("bad ionice spec: " + raw)
+	}
+
+	class, errPc := strconv.Atoi(parts[0])
+	if errPc != nil {
+		return 0, 0, errors.New("bad ionice spec: " + errPc.Error())
+	}
+
+	priority, errPp := strconv.Atoi(parts[1])
+	if errPp != nil {
+		return 0, 0, errors.New("bad ionice spec: " + errPp.Error())
+	}
+
+	return class, priority, nil
+}
+
+// applySandbox applies cfg.defaultNice and, for allow-listed commands, spec's overrides to the
+// already-started process pid. It must run between cmd.Start() and cmd.Wait()/waitForCmd(). A
+// Setpriority failure (e.g. EPERM if we're niced below cfg.defaultNice ourselves) only logs a warning,
+// since it's no more fatal to the request than a failed progress-publish or metrics update.
+func applySandbox(pid int, command string, spec sandboxSpec, cfg sandboxConfig) error {
+	allowed := cfg.allowOverrides[command]
+
+	nice := cfg.defaultNice
+	if spec.Nice != nil && allowed {
+		nice = *spec.Nice
+	}
+
+	if errSp := unix.Setpriority(unix.PRIO_PROCESS, pid, nice); errSp != nil {
+		log.WithFields(log.Fields{"command": command, "error": errSp.Error()}).Warn("couldn't set nice value")
+	}
+
+	if !allowed {
+		return nil
+	}
+
+	for name, limit := range spec.Rlimits {
+		if errPl := unix.Prlimit(pid, rlimitResources[name], &unix.Rlimit{Cur: limit.Soft, Max: limit.Hard}, nil); errPl != nil {
+			return fmt.Errorf("couldn't set rlimit %s: %w", name, errPl)
+		}
+	}
+
+	if spec.Cgroup != "" {
+		cgroup, errRc := resolveCgroup(cfg.cgroupRoot, spec.Cgroup)
+		if errRc != nil {
+			return errRc
+		}
+
+		procsFile := filepath.Join(cgroup, "cgroup.procs")
+		if errWf := ioutil.WriteFile(procsFile, []byte(strconv.Itoa(pid)), 0644); errWf != nil {
+			return fmt.Errorf("couldn't join cgroup %s: %w", cgroup, errWf)
+		}
+	}
+
+	if spec.Ionice != nil {
+		ioprio := spec.Ionice.Class<<13 | spec.Ionice.Priority
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("couldn't set ionice value: %w", errno)
+		}
+	}
+
+	return nil
+}
+
+// resolveCgroup joins root and cgroup, rejecting any result that escapes root (e.g. via "..").
+func resolveCgroup(root, cgroup string) (string, error) {
+	if root == "" {
+		return "", errors.New("cgroup sandboxing requires [sandbox] cgroup_root to be configured")
+	}
+
+	joined := filepath.Join(root, cgroup)
+
+	rel, errRl := filepath.Rel(root, joined)
+	if errRl != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("cgroup escapes cgroup_root: " + cgroup)
+	}
+
+	return joined, nil
+}
+
+// stringSetOf turns items into a set for cheap membership checks.
+func stringSetOf(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+
+	for _, item := range items {
+		set[item] = true
+	}
+
+	return set
+}